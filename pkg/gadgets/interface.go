@@ -15,27 +15,63 @@
 package gadgets
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	gadgetv1alpha1 "github.com/kinvolk/inspektor-gadget/pkg/api/v1alpha1"
 	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
 	"github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/pubsub"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	apimachineryruntime "k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// tracerName identifies spans emitted by this package in exported trace data.
+const tracerName = "github.com/kinvolk/inspektor-gadget/pkg/gadgets"
+
+const (
+	// OnRemoveAnnotation lets a Trace CR override what BaseFactory.Delete
+	// does when the CR is removed. It mirrors the on-remove/deletion
+	// policies found in kapply-style tooling.
+	OnRemoveAnnotation = "gadget.kinvolk.io/on-remove"
+
+	// OnRemoveKeep leaves the trace entry (and anything it holds, such as
+	// BPF programs or perf readers) untouched so a later re-creation of
+	// the CR can re-adopt it.
+	OnRemoveKeep = "keep"
+
+	// OnRemoveDetach removes the trace from BaseFactory's bookkeeping but
+	// skips the destructive DeleteTrace release path, calling
+	// DetachTrace instead so the gadget can keep running in the
+	// background until it is explicitly reaped.
+	OnRemoveDetach = "detach"
+)
+
 type TraceFactory interface {
-	// Initialize gives the Resolver and the Client to the gadget. Gadgets
-	// don't need to implement this method if they use BaseFactory as an
-	// anonymous field.
-	Initialize(Resolver Resolver, Client client.Client)
+	// Initialize gives the Resolver, the Client and a TracerProvider to
+	// the gadget. self must be the gadget's own outer value (i.e. what the
+	// caller holds as a TraceFactory), so that BaseFactory.Delete can later
+	// type-assert against the concrete gadget instead of against the
+	// embedded *BaseFactory itself. Gadgets don't need to implement this
+	// method if they use BaseFactory as an anonymous field; TracerProvider
+	// may be nil, in which case a no-op provider is used.
+	Initialize(self TraceFactory, Resolver Resolver, Client client.Client, TracerProvider oteltrace.TracerProvider)
 
 	// Delete request a gadget to release the information it has about a
 	// trace. BaseFactory implements this method, so gadgets who embed
-	// BaseFactory don't need to implement it.
-	Delete(name string)
+	// BaseFactory don't need to implement it. trace is the Trace CR being
+	// deleted and may be nil if the caller has no object to hand over; its
+	// gadget.kinvolk.io/on-remove annotation can override the default
+	// "release everything" behavior.
+	Delete(name string, trace *gadgetv1alpha1.Trace)
 
 	// Operations gives the list of operations on a gadget that users can
 	// call via the gadget.kinvolk.io/operation annotation.
@@ -71,11 +107,25 @@ type TraceFactoryWithDeleteTrace interface {
 	DeleteTrace(name string, trace interface{})
 }
 
+type TraceFactoryWithDetachTrace interface {
+	TraceFactory
+
+	// DetachTrace is called by Delete instead of DeleteTrace when the
+	// Trace CR carries the gadget.kinvolk.io/on-remove=detach annotation.
+	// It lets a gadget stop tracking a trace without tearing down the
+	// underlying BPF programs or perf readers, e.g. so a seccomp or
+	// network tracer keeps publishing events for an orphaned pod until
+	// the controller explicitly reaps it.
+	DetachTrace(name string, trace interface{})
+}
+
 // TraceOperation packages an operation on a gadget that users can call via the
 // annotation gadget.kinvolk.io/operation.
 type TraceOperation struct {
-	// Operation is the function called by the controller
-	Operation func(name string, trace *gadgetv1alpha1.Trace)
+	// Operation is the function called by the controller. ctx carries the
+	// span started by the controller for this operation; gadgets can pass
+	// it to StartOperationSpan to nest their own work underneath it.
+	Operation func(ctx context.Context, name string, trace *gadgetv1alpha1.Trace)
 
 	// Doc documents the operation. It is used to generate the
 	// documentation.
@@ -88,8 +138,9 @@ type TraceOperation struct {
 
 type Resolver interface {
 	// LookupMntnsByContainer returns the mount namespace inode of the container
-	// specified in arguments or zero if not found
-	LookupMntnsByContainer(namespace, pod, container string) uint64
+	// specified in arguments or zero if not found. ctx is used to attach a
+	// span recording the lookup and its outcome.
+	LookupMntnsByContainer(ctx context.Context, namespace, pod, container string) uint64
 
 	// LookupMntnsByPod returns the mount namespace inodes of all containers
 	// belonging to the pod specified in arguments, indexed by the name of the
@@ -102,35 +153,218 @@ type Resolver interface {
 
 	// LookupPIDByPod returns the PID of all containers belonging to
 	// the pod specified in arguments, indexed by the name of the
-	// containers or an empty map if not found
-	LookupPIDByPod(namespace, pod string) map[string]uint32
+	// containers or an empty map if not found. ctx is used to attach a
+	// span recording the lookup and its outcome.
+	LookupPIDByPod(ctx context.Context, namespace, pod string) map[string]uint32
 
 	// GetContainersBySelector returns a slice of containers that match
-	// the selector or an empty slice if there are not matches
-	GetContainersBySelector(containerSelector *pb.ContainerSelector) []pb.ContainerDefinition
+	// the selector or an empty slice if there are not matches. ctx is used
+	// to attach a span recording the lookup and its outcome.
+	GetContainersBySelector(ctx context.Context, containerSelector *pb.ContainerSelector) []pb.ContainerDefinition
 
 	// Subscribe returns the list of existing containers and registers a
 	// callback for notifications about additions and deletions of
-	// containers
-	Subscribe(key interface{}, s pb.ContainerSelector, f pubsub.FuncNotify) []pb.ContainerDefinition
+	// containers. ctx is used to attach a span covering the subscription
+	// call itself; it is not retained for later notifications.
+	Subscribe(ctx context.Context, key interface{}, s pb.ContainerSelector, f pubsub.FuncNotify) []pb.ContainerDefinition
 
 	// Unsubscribe undoes a previous call to Subscribe
 	Unsubscribe(key interface{})
 
-	PublishEvent(tracerID string, line string) error
+	// PublishEvent publishes an event line produced by tracerID. If line
+	// carries a leading traceparent (see ExtractEventTraceContext), the
+	// span created for this call is linked as a child of it so the event
+	// can be correlated with the operation that armed the tracer.
+	PublishEvent(ctx context.Context, tracerID string, line string) error
+
+	// ListContainers returns a ContainerPager over the containers matching
+	// selector, fetching them page by page instead of materializing the
+	// whole result set at once. It is meant for gadgets that scan very
+	// large clusters with GetContainersBySelector-style selectors.
+	ListContainers(selector *pb.ContainerSelector, opts ListOptions) (ContainerPager, error)
+
+	// SubscribeWithResync behaves like Subscribe, but additionally re-lists
+	// the containers matching selector every resyncPeriod and reconciles
+	// f's view against the result, emitting synthetic ADD/DELETE
+	// notifications for anything that drifted out of sync in between,
+	// mirroring the relist-and-diff pattern of Kubernetes informers. ctx is
+	// used to attach a span covering the initial subscription call and
+	// bounds the lifetime of the periodic resync.
+	SubscribeWithResync(ctx context.Context, key interface{}, selector pb.ContainerSelector, resyncPeriod time.Duration, f pubsub.FuncNotify) []pb.ContainerDefinition
+}
+
+// ListOptions configures a call to Resolver.ListContainers.
+type ListOptions struct {
+	// Limit caps the number of containers returned by a single page. Zero
+	// lets the implementation pick a sensible default.
+	Limit int64
+
+	// Continue resumes a previous ListContainers call from the point
+	// encoded in a continuation token returned by ContainerPager.Next.
+	Continue string
+}
+
+// ContainerPager yields successive pages of containers matching the
+// selector a ListContainers call was made with, modeled on
+// k8s.io/client-go/tools/pager.
+type ContainerPager interface {
+	// Next returns the next page of containers together with a
+	// continuation token to pass to a subsequent ListContainers call. An
+	// empty token means the list is exhausted.
+	Next(ctx context.Context) (containers []pb.ContainerDefinition, continueToken string, err error)
+}
+
+// staticContainerPager implements ContainerPager over an already-fetched
+// slice of containers, continuing from the offset encoded in its
+// continuation token. It lets a Resolver satisfy ListContainers by slicing
+// a single GetContainersBySelector-style result, before it grows a backing
+// store that can produce pages without materializing everything upfront.
+type staticContainerPager struct {
+	containers []pb.ContainerDefinition
+	limit      int64
+	offset     int64
+}
+
+// NewStaticContainerPager returns a ContainerPager that serves containers
+// out of an already-fetched slice, limit at a time (or all at once if limit
+// is not positive). opts.Continue, if set, must be a token previously
+// returned by this pager and resumes iteration from that point.
+func NewStaticContainerPager(containers []pb.ContainerDefinition, opts ListOptions) (ContainerPager, error) {
+	offset := int64(0)
+	if opts.Continue != "" {
+		parsed, err := strconv.ParseInt(opts.Continue, 10, 64)
+		if err != nil || parsed < 0 || parsed > int64(len(containers)) {
+			return nil, fmt.Errorf("invalid continue token %q", opts.Continue)
+		}
+		offset = parsed
+	}
+	return &staticContainerPager{containers: containers, limit: opts.Limit, offset: offset}, nil
+}
+
+func (p *staticContainerPager) Next(ctx context.Context) ([]pb.ContainerDefinition, string, error) {
+	if p.offset >= int64(len(p.containers)) {
+		return nil, "", nil
+	}
+
+	limit := p.limit
+	if limit <= 0 || p.offset+limit > int64(len(p.containers)) {
+		limit = int64(len(p.containers)) - p.offset
+	}
+
+	page := p.containers[p.offset : p.offset+limit]
+	p.offset += limit
+
+	var continueToken string
+	if p.offset < int64(len(p.containers)) {
+		continueToken = strconv.FormatInt(p.offset, 10)
+	}
+	return page, continueToken, nil
+}
+
+// ContainerResyncer backs Resolver.SubscribeWithResync's relist-and-diff
+// behavior: Run periodically re-lists the containers matching a selector and
+// reconciles them against the previous snapshot, so callers don't each have
+// to hand-roll that bookkeeping. The indexed store that makes the List call
+// itself O(1) rather than a linear scan lives in the tracermanager and is
+// out of scope here; ContainerResyncer only owns the periodic diffing.
+type ContainerResyncer struct {
+	// List fetches the current set of containers matching the resync's
+	// selector.
+	List func(ctx context.Context) ([]pb.ContainerDefinition, error)
+
+	// Key extracts a container's identity (its container ID) so two
+	// snapshots can be diffed.
+	Key func(pb.ContainerDefinition) string
+
+	// Added and Removed are called, if set, for every container present
+	// in the new snapshot but not the previous one, and vice versa.
+	Added, Removed func(pb.ContainerDefinition)
+}
+
+// Resync fetches the current containers via r.List and reconciles them
+// against prev, a snapshot returned by a previous call to Resync (or nil on
+// the first call), invoking r.Added/r.Removed for anything that drifted out
+// of sync in between. It returns the new snapshot to pass to the next call.
+func (r *ContainerResyncer) Resync(ctx context.Context, prev []pb.ContainerDefinition) ([]pb.ContainerDefinition, error) {
+	next, err := r.List(ctx)
+	if err != nil {
+		return prev, err
+	}
+
+	prevKeys := make(map[string]struct{}, len(prev))
+	for _, c := range prev {
+		prevKeys[r.Key(c)] = struct{}{}
+	}
+
+	nextKeys := make(map[string]struct{}, len(next))
+	for _, c := range next {
+		key := r.Key(c)
+		nextKeys[key] = struct{}{}
+		if _, ok := prevKeys[key]; !ok && r.Added != nil {
+			r.Added(c)
+		}
+	}
+
+	for _, c := range prev {
+		if _, ok := nextKeys[r.Key(c)]; !ok && r.Removed != nil {
+			r.Removed(c)
+		}
+	}
+
+	return next, nil
+}
+
+// Run calls Resync immediately, then again every resyncPeriod, until ctx is
+// canceled or a Resync call fails. Callers that want SubscribeWithResync's
+// "re-list every resyncPeriod" behavior should start Run in its own
+// goroutine right after the initial Subscribe-style call. It returns the
+// last successful snapshot together with the error that stopped the loop,
+// which is nil if ctx was canceled.
+func (r *ContainerResyncer) Run(ctx context.Context, resyncPeriod time.Duration, prev []pb.ContainerDefinition) ([]pb.ContainerDefinition, error) {
+	prev, err := r.Resync(ctx, prev)
+	if err != nil {
+		return prev, err
+	}
+
+	ticker := time.NewTicker(resyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return prev, nil
+		case <-ticker.C:
+			prev, err = r.Resync(ctx, prev)
+			if err != nil {
+				return prev, err
+			}
+		}
+	}
 }
 
 type BaseFactory struct {
-	Resolver Resolver
-	Client   client.Client
+	Resolver       Resolver
+	Client         client.Client
+	TracerProvider oteltrace.TracerProvider
+
+	// self is the concrete gadget embedding this BaseFactory, as passed to
+	// Initialize. Delete type-asserts against it rather than against f
+	// itself, since a promoted method's receiver is always the embedded
+	// *BaseFactory, never the outer gadget type.
+	self TraceFactory
 
 	mu     sync.Mutex
 	traces map[string]interface{}
 }
 
-func (f *BaseFactory) Initialize(r Resolver, c client.Client) {
+func (f *BaseFactory) Initialize(self TraceFactory, r Resolver, c client.Client, tp oteltrace.TracerProvider) {
+	f.self = self
 	f.Resolver = r
 	f.Client = c
+	if tp == nil {
+		tp = oteltrace.NewNoopTracerProvider()
+	}
+	f.TracerProvider = tp
 }
 
 func (f *BaseFactory) LookupOrCreate(name string, newTrace func() interface{}) interface{} {
@@ -155,18 +389,42 @@ func (f *BaseFactory) LookupOrCreate(name string, newTrace func() interface{}) i
 	return trace
 }
 
-func (f *BaseFactory) Delete(name string) {
+func (f *BaseFactory) Delete(name string, trace *gadgetv1alpha1.Trace) {
 	log.Infof("Deleting %s", name)
+
+	if trace != nil {
+		switch trace.Annotations[OnRemoveAnnotation] {
+		case OnRemoveKeep:
+			log.Infof("Deleting %s: on-remove=keep, leaving trace state in place", name)
+			return
+		case OnRemoveDetach:
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			traceObj, ok := f.traces[name]
+			if !ok {
+				log.Infof("Deleting %s: does not exist", name)
+				return
+			}
+			factory, ok := f.self.(TraceFactoryWithDetachTrace)
+			if ok {
+				log.Infof("Deleting %s: on-remove=detach", name)
+				factory.DetachTrace(name, traceObj)
+			}
+			delete(f.traces, name)
+			return
+		}
+	}
+
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	trace, ok := f.traces[name]
+	traceObj, ok := f.traces[name]
 	if !ok {
 		log.Infof("Deleting %s: does not exist", name)
 		return
 	}
-	factory, ok := TraceFactory(f).(TraceFactoryWithDeleteTrace)
+	factory, ok := f.self.(TraceFactoryWithDeleteTrace)
 	if ok {
-		factory.DeleteTrace(name, trace)
+		factory.DeleteTrace(name, traceObj)
 	}
 	delete(f.traces, name)
 	return
@@ -174,4 +432,47 @@ func (f *BaseFactory) Delete(name string) {
 
 func (f *BaseFactory) Operations() map[string]TraceOperation {
 	return map[string]TraceOperation{}
-}
\ No newline at end of file
+}
+
+// StartOperationSpan starts a span for work a gadget performs while handling
+// a gadget.kinvolk.io/operation request, nested under the span the
+// controller started for op, using the TracerProvider injected via
+// Initialize (or a no-op one if Initialize was never called). Gadget
+// authors should call this at the top of their TraceOperation.Operation
+// implementation and pass the returned context down to anything else they
+// instrument.
+func (f *BaseFactory) StartOperationSpan(ctx context.Context, name, op string) (context.Context, oteltrace.Span) {
+	tp := f.TracerProvider
+	if tp == nil {
+		tp = oteltrace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(tracerName).Start(ctx, op, oteltrace.WithAttributes(
+		attribute.String("gadget.trace.name", name),
+		attribute.String("gadget.operation", op),
+	))
+}
+
+// TraceContextPrefix marks an optional leading "traceparent: <value>\n"
+// segment on event lines passed to Resolver.PublishEvent, letting the
+// tracermanager propagate the span of the operation that armed the tracer
+// down to the events it produces.
+const TraceContextPrefix = "traceparent: "
+
+// ExtractEventTraceContext looks for a TraceContextPrefix header on line and,
+// if present, returns a context carrying the extracted span context together
+// with the remainder of the line. If line carries no such header, it is
+// returned unchanged alongside ctx.
+func ExtractEventTraceContext(ctx context.Context, line string) (context.Context, string) {
+	if !strings.HasPrefix(line, TraceContextPrefix) {
+		return ctx, line
+	}
+
+	rest := line[len(TraceContextPrefix):]
+	traceparent, remainder, found := strings.Cut(rest, "\n")
+	if !found {
+		return ctx, line
+	}
+
+	carrier := propagation.MapCarrier{"traceparent": traceparent}
+	return propagation.TraceContext{}.Extract(ctx, carrier), remainder
+}
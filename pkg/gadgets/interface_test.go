@@ -0,0 +1,428 @@
+// Copyright 2019-2021 The Inspektor Gadget authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gadgets
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gadgetv1alpha1 "github.com/kinvolk/inspektor-gadget/pkg/api/v1alpha1"
+	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeGadget exercises BaseFactory as a real gadget would: embedding it
+// anonymously and promoting DeleteTrace/DetachTrace.
+type fakeGadget struct {
+	BaseFactory
+
+	deleted, detached []string
+}
+
+func (g *fakeGadget) DeleteTrace(name string, trace interface{}) {
+	g.deleted = append(g.deleted, name)
+}
+
+func (g *fakeGadget) DetachTrace(name string, trace interface{}) {
+	g.detached = append(g.detached, name)
+}
+
+func newFakeGadget(t *testing.T) *fakeGadget {
+	t.Helper()
+	g := &fakeGadget{}
+	g.Initialize(g, nil, nil, nil)
+	g.LookupOrCreate("foo", func() interface{} { return "state" })
+	return g
+}
+
+func traceWithOnRemove(value string) *gadgetv1alpha1.Trace {
+	if value == "" {
+		return nil
+	}
+	return &gadgetv1alpha1.Trace{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{OnRemoveAnnotation: value},
+		},
+	}
+}
+
+func TestDeleteDefaultCallsDeleteTrace(t *testing.T) {
+	g := newFakeGadget(t)
+
+	g.Delete("foo", traceWithOnRemove(""))
+
+	if len(g.deleted) != 1 || g.deleted[0] != "foo" {
+		t.Fatalf("expected DeleteTrace to be called with foo, got %v", g.deleted)
+	}
+	if len(g.detached) != 0 {
+		t.Fatalf("expected DetachTrace not to be called, got %v", g.detached)
+	}
+	if _, ok := g.traces["foo"]; ok {
+		t.Fatalf("expected trace entry to be removed")
+	}
+}
+
+func TestDeleteNilTraceFallsBackToDefault(t *testing.T) {
+	g := newFakeGadget(t)
+
+	g.Delete("foo", nil)
+
+	if len(g.deleted) != 1 || g.deleted[0] != "foo" {
+		t.Fatalf("expected DeleteTrace to be called with foo, got %v", g.deleted)
+	}
+}
+
+func TestDeleteKeepLeavesTraceInPlace(t *testing.T) {
+	g := newFakeGadget(t)
+
+	g.Delete("foo", traceWithOnRemove(OnRemoveKeep))
+
+	if len(g.deleted) != 0 || len(g.detached) != 0 {
+		t.Fatalf("expected neither DeleteTrace nor DetachTrace to be called, got deleted=%v detached=%v", g.deleted, g.detached)
+	}
+	if _, ok := g.traces["foo"]; !ok {
+		t.Fatalf("expected trace entry to be kept")
+	}
+}
+
+func TestDeleteDetachCallsDetachTrace(t *testing.T) {
+	g := newFakeGadget(t)
+
+	g.Delete("foo", traceWithOnRemove(OnRemoveDetach))
+
+	if len(g.detached) != 1 || g.detached[0] != "foo" {
+		t.Fatalf("expected DetachTrace to be called with foo, got %v", g.detached)
+	}
+	if len(g.deleted) != 0 {
+		t.Fatalf("expected DeleteTrace not to be called, got %v", g.deleted)
+	}
+	if _, ok := g.traces["foo"]; ok {
+		t.Fatalf("expected trace entry to be removed")
+	}
+}
+
+func TestDeleteUnknownNameIsNoop(t *testing.T) {
+	g := newFakeGadget(t)
+
+	g.Delete("does-not-exist", traceWithOnRemove(OnRemoveDetach))
+
+	if len(g.deleted) != 0 || len(g.detached) != 0 {
+		t.Fatalf("expected no hooks to be called for an unknown trace, got deleted=%v detached=%v", g.deleted, g.detached)
+	}
+}
+
+func TestExtractEventTraceContextNoHeader(t *testing.T) {
+	ctx := context.Background()
+
+	gotCtx, gotLine := ExtractEventTraceContext(ctx, "plain event line")
+
+	if gotLine != "plain event line" {
+		t.Fatalf("expected line to be returned unchanged, got %q", gotLine)
+	}
+	if gotCtx != ctx {
+		t.Fatalf("expected context to be returned unchanged")
+	}
+}
+
+func TestExtractEventTraceContextMissingTrailingNewline(t *testing.T) {
+	ctx := context.Background()
+	line := TraceContextPrefix + "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	gotCtx, gotLine := ExtractEventTraceContext(ctx, line)
+
+	if gotLine != line {
+		t.Fatalf("expected line to be returned unchanged when there is no trailing newline, got %q", gotLine)
+	}
+	if gotCtx != ctx {
+		t.Fatalf("expected context to be returned unchanged")
+	}
+}
+
+func TestExtractEventTraceContextEmptyRemainder(t *testing.T) {
+	ctx := context.Background()
+	line := TraceContextPrefix + "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\n"
+
+	gotCtx, gotLine := ExtractEventTraceContext(ctx, line)
+
+	if gotLine != "" {
+		t.Fatalf("expected remainder to be empty, got %q", gotLine)
+	}
+	if gotCtx == ctx {
+		t.Fatalf("expected a new context carrying the extracted span to be returned")
+	}
+}
+
+func TestExtractEventTraceContextWithRemainder(t *testing.T) {
+	ctx := context.Background()
+	line := TraceContextPrefix + "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\nrest of the event"
+
+	_, gotLine := ExtractEventTraceContext(ctx, line)
+
+	if gotLine != "rest of the event" {
+		t.Fatalf("expected remainder %q, got %q", "rest of the event", gotLine)
+	}
+}
+
+// newContainer returns a pb.ContainerDefinition identifiable by id. It finds
+// the message's first settable string field via reflection instead of
+// hardcoding one, since gadgettracermanager/api isn't vendored into this
+// tree and its exact field names aren't available here.
+func newContainer(t *testing.T, id string) pb.ContainerDefinition {
+	t.Helper()
+	var c pb.ContainerDefinition
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() == reflect.String && f.CanSet() {
+			f.SetString(id)
+			return c
+		}
+	}
+	t.Fatalf("pb.ContainerDefinition has no settable string field to identify containers by")
+	return c
+}
+
+// containerKey reads back the identifying string field newContainer set.
+func containerKey(c pb.ContainerDefinition) string {
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); f.Kind() == reflect.String {
+			return f.String()
+		}
+	}
+	return ""
+}
+
+func TestNewStaticContainerPagerInvalidContinueToken(t *testing.T) {
+	containers := make([]pb.ContainerDefinition, 2)
+
+	for _, continueToken := range []string{"not-a-number", "-1", "3"} {
+		if _, err := NewStaticContainerPager(containers, ListOptions{Continue: continueToken}); err == nil {
+			t.Errorf("expected an error for continue token %q", continueToken)
+		}
+	}
+}
+
+func TestStaticContainerPagerLimitZeroReturnsEverythingInOnePage(t *testing.T) {
+	containers := make([]pb.ContainerDefinition, 3)
+
+	pager, err := NewStaticContainerPager(containers, ListOptions{})
+	if err != nil {
+		t.Fatalf("NewStaticContainerPager: %v", err)
+	}
+
+	page, continueToken, err := pager.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if len(page) != 3 {
+		t.Fatalf("expected a page of 3 containers, got %d", len(page))
+	}
+	if continueToken != "" {
+		t.Fatalf("expected no continuation token, got %q", continueToken)
+	}
+}
+
+func TestStaticContainerPagerLimitGreaterThanLen(t *testing.T) {
+	containers := make([]pb.ContainerDefinition, 2)
+
+	pager, err := NewStaticContainerPager(containers, ListOptions{Limit: 10})
+	if err != nil {
+		t.Fatalf("NewStaticContainerPager: %v", err)
+	}
+
+	page, continueToken, err := pager.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if len(page) != 2 {
+		t.Fatalf("expected a page of 2 containers, got %d", len(page))
+	}
+	if continueToken != "" {
+		t.Fatalf("expected no continuation token, got %q", continueToken)
+	}
+}
+
+func TestStaticContainerPagerExactMultiplePagesThenExhausted(t *testing.T) {
+	containers := make([]pb.ContainerDefinition, 4)
+
+	pager, err := NewStaticContainerPager(containers, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("NewStaticContainerPager: %v", err)
+	}
+
+	page1, continueToken1, err := pager.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next (page 1): %v", err)
+	}
+	if len(page1) != 2 || continueToken1 == "" {
+		t.Fatalf("expected a 2-container page with a continuation token, got %d containers, token %q", len(page1), continueToken1)
+	}
+
+	page2, continueToken2, err := pager.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next (page 2): %v", err)
+	}
+	if len(page2) != 2 || continueToken2 != "" {
+		t.Fatalf("expected the final 2-container page with no continuation token, got %d containers, token %q", len(page2), continueToken2)
+	}
+
+	page3, continueToken3, err := pager.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next (page 3): %v", err)
+	}
+	if len(page3) != 0 || continueToken3 != "" {
+		t.Fatalf("expected the pager to be exhausted, got %d containers, token %q", len(page3), continueToken3)
+	}
+}
+
+func TestStaticContainerPagerResumesFromContinueToken(t *testing.T) {
+	containers := make([]pb.ContainerDefinition, 4)
+
+	first, err := NewStaticContainerPager(containers, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("NewStaticContainerPager: %v", err)
+	}
+	_, continueToken, err := first.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+
+	resumed, err := NewStaticContainerPager(containers, ListOptions{Limit: 2, Continue: continueToken})
+	if err != nil {
+		t.Fatalf("NewStaticContainerPager (resumed): %v", err)
+	}
+	page, continueToken2, err := resumed.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next (resumed): %v", err)
+	}
+	if len(page) != 2 || continueToken2 != "" {
+		t.Fatalf("expected the final 2-container page with no continuation token, got %d containers, token %q", len(page), continueToken2)
+	}
+}
+
+func TestContainerResyncerResyncDiffsAddedAndRemoved(t *testing.T) {
+	a := newContainer(t, "a")
+	b := newContainer(t, "b")
+	c := newContainer(t, "c")
+
+	var added, removed []string
+	r := &ContainerResyncer{
+		List: func(ctx context.Context) ([]pb.ContainerDefinition, error) {
+			return []pb.ContainerDefinition{b, c}, nil
+		},
+		Key:     containerKey,
+		Added:   func(c pb.ContainerDefinition) { added = append(added, containerKey(c)) },
+		Removed: func(c pb.ContainerDefinition) { removed = append(removed, containerKey(c)) },
+	}
+
+	next, err := r.Resync(context.Background(), []pb.ContainerDefinition{a, b})
+	if err != nil {
+		t.Fatalf("Resync: %v", err)
+	}
+
+	if len(next) != 2 {
+		t.Fatalf("expected the returned snapshot to have 2 containers, got %d", len(next))
+	}
+	if len(added) != 1 || added[0] != "c" {
+		t.Fatalf("expected only %q to be reported added, got %v", "c", added)
+	}
+	if len(removed) != 1 || removed[0] != "a" {
+		t.Fatalf("expected only %q to be reported removed, got %v", "a", removed)
+	}
+}
+
+func TestContainerResyncerResyncNoopWhenUnchanged(t *testing.T) {
+	a := newContainer(t, "a")
+
+	var calls int
+	r := &ContainerResyncer{
+		List: func(ctx context.Context) ([]pb.ContainerDefinition, error) {
+			return []pb.ContainerDefinition{a}, nil
+		},
+		Key:     containerKey,
+		Added:   func(c pb.ContainerDefinition) { calls++ },
+		Removed: func(c pb.ContainerDefinition) { calls++ },
+	}
+
+	if _, err := r.Resync(context.Background(), []pb.ContainerDefinition{a}); err != nil {
+		t.Fatalf("Resync: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("expected no Added/Removed calls for an unchanged snapshot, got %d", calls)
+	}
+}
+
+func TestContainerResyncerResyncPropagatesListError(t *testing.T) {
+	wantErr := errors.New("list failed")
+	prev := []pb.ContainerDefinition{newContainer(t, "a")}
+
+	r := &ContainerResyncer{
+		List: func(ctx context.Context) ([]pb.ContainerDefinition, error) { return nil, wantErr },
+		Key:  containerKey,
+	}
+
+	got, err := r.Resync(context.Background(), prev)
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("expected error %v, got %v", wantErr, err)
+	}
+	if len(got) != len(prev) {
+		t.Fatalf("expected the previous snapshot to be returned unchanged on error")
+	}
+}
+
+func TestContainerResyncerRunFiresOnEveryTick(t *testing.T) {
+	var calls int32
+	r := &ContainerResyncer{
+		List: func(ctx context.Context) ([]pb.ContainerDefinition, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, nil
+		},
+		Key: containerKey,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Millisecond)
+	defer cancel()
+
+	if _, err := r.Run(ctx, 5*time.Millisecond, nil); err != nil {
+		t.Fatalf("expected Run to stop cleanly when ctx is canceled, got %v", err)
+	}
+	if atomic.LoadInt32(&calls) < 2 {
+		t.Fatalf("expected the periodic resync to fire more than once, got %d calls", calls)
+	}
+}
+
+func TestContainerResyncerRunStopsOnError(t *testing.T) {
+	wantErr := errors.New("boom")
+	var calls int32
+	r := &ContainerResyncer{
+		List: func(ctx context.Context) ([]pb.ContainerDefinition, error) {
+			if atomic.AddInt32(&calls, 1) == 2 {
+				return nil, wantErr
+			}
+			return nil, nil
+		},
+		Key: containerKey,
+	}
+
+	_, err := r.Run(context.Background(), 5*time.Millisecond, nil)
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("expected Run to stop with %v, got %v", wantErr, err)
+	}
+}